@@ -0,0 +1,214 @@
+package cluster
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/code-ready/crc/pkg/crc/errors"
+	"github.com/code-ready/crc/pkg/crc/logging"
+	"github.com/code-ready/crc/pkg/crc/oc"
+	"github.com/code-ready/crc/pkg/crc/ssh"
+)
+
+// staticPodOperators are the cluster operators that must be forced to roll a
+// new revision once kubelet re-issues its client/server certs, otherwise
+// they keep serving the stale static-pod manifests referencing the old certs.
+// OperatorResource is the cluster-scoped operator CR, not the operator's own
+// Deployment (which is not named after its namespace and whose pod template
+// restarting has no bearing on the static pods it renders).
+var staticPodOperators = []struct {
+	Namespace        string
+	OperatorResource string
+}{
+	{Namespace: "openshift-kube-apiserver-operator", OperatorResource: "kubeapiservers.operator.openshift.io/cluster"},
+	{Namespace: "openshift-kube-controller-manager-operator", OperatorResource: "kubecontrollermanagers.operator.openshift.io/cluster"},
+	{Namespace: "openshift-kube-scheduler-operator", OperatorResource: "kubeschedulers.operator.openshift.io/cluster"},
+}
+
+// signerSecretsToRotate maps the remaining cluster signers/certs that do not
+// self-renew on kubelet restart to the namespace/secret holding them. Deleting
+// the secret causes the owning operator to regenerate it from its signer.
+var signerSecretsToRotate = map[string]string{
+	"openshift-kube-apiserver-operator": "aggregator-client-signer",
+	"openshift-service-ca":              "signing-key",
+	"openshift-etcd":                    "etcd-peer-signer",
+	"openshift-etcd-operator":           "etcd-serving-signer",
+}
+
+// CertRotationReport summarizes the outcome of a RotateCerts call so callers
+// can surface what changed and when the VM will next need attention.
+type CertRotationReport struct {
+	Renewed           []string
+	StillValid        []string
+	NextRenewalNeeded time.Time
+}
+
+// RotateCerts regenerates the cluster's kubelet client/server certs and the
+// associated signers when they have already expired, so that a CRC VM whose
+// embedded certs have aged out does not have to be thrown away. It is a
+// no-op (beyond reporting) when the certs are still valid.
+func RotateCerts(sshRunner *ssh.Runner, ocConfig oc.Config) (*CertRotationReport, error) {
+	return rotateCerts(sshRunner, ocConfig, false)
+}
+
+// ForceRotateCerts reissues the kubelet client/server certs and forces new
+// static-pod revisions even if the kubelet certs have not expired yet. The
+// signer secrets are still only rotated when they themselves have expired
+// (see rotateSignerSecret). Callers use this
+// when the certs' embedded hostnames are no longer correct, e.g. after a
+// base domain change, rather than waiting for natural expiry.
+func ForceRotateCerts(sshRunner *ssh.Runner, ocConfig oc.Config) (*CertRotationReport, error) {
+	return rotateCerts(sshRunner, ocConfig, true)
+}
+
+func rotateCerts(sshRunner *ssh.Runner, ocConfig oc.Config, force bool) (*CertRotationReport, error) {
+	report := &CertRotationReport{}
+
+	state, err := CheckCertsValidity(sshRunner)
+	if err != nil && state != CertExpired {
+		return nil, err
+	}
+	if state == CertNotExpired && !force {
+		certExpiryDate, err := getcertExpiryDateFromVM(sshRunner)
+		if err != nil {
+			return nil, err
+		}
+		report.StillValid = append(report.StillValid, "kubelet-client")
+		report.NextRenewalNeeded = certExpiryDate
+		return report, nil
+	}
+
+	if force {
+		logging.Debugf("Forcing cluster cert rotation")
+	} else {
+		logging.Debugf("Kubelet client cert has expired, rotating cluster certs")
+	}
+
+	if _, err := sshRunner.Run("sudo systemctl stop kubelet crio"); err != nil {
+		return nil, fmt.Errorf("Failed to stop kubelet/crio: %v", err)
+	}
+
+	if _, err := sshRunner.Run("sudo rm -f /var/lib/kubelet/pki/kubelet-client-current.pem /var/lib/kubelet/pki/kubelet-server-current.pem"); err != nil {
+		return nil, fmt.Errorf("Failed to remove stale kubelet certs: %v", err)
+	}
+
+	if _, err := sshRunner.Run("sudo systemctl start crio kubelet"); err != nil {
+		return nil, fmt.Errorf("Failed to restart kubelet/crio: %v", err)
+	}
+	report.Renewed = append(report.Renewed, "kubelet-client", "kubelet-server")
+
+	if err := approvePendingCSRs(ocConfig); err != nil {
+		return nil, err
+	}
+
+	for _, operator := range staticPodOperators {
+		if err := forceOperatorRevision(ocConfig, operator.OperatorResource); err != nil {
+			return nil, err
+		}
+		report.Renewed = append(report.Renewed, operator.OperatorResource)
+	}
+
+	for namespace, secret := range signerSecretsToRotate {
+		rotated, err := rotateSignerSecret(ocConfig, namespace, secret)
+		if err != nil {
+			return nil, err
+		}
+		if rotated {
+			report.Renewed = append(report.Renewed, secret)
+		} else {
+			report.StillValid = append(report.StillValid, secret)
+		}
+	}
+
+	certExpiryDate, err := getcertExpiryDateFromVM(sshRunner)
+	if err != nil {
+		return nil, err
+	}
+	report.NextRenewalNeeded = certExpiryDate
+
+	return report, nil
+}
+
+func approvePendingCSRs(ocConfig oc.Config) error {
+	approveCSRs := func() error {
+		stdout, _, err := ocConfig.RunOcCommand("get", "csr", "-o", `jsonpath={.items[?(@.status=={})].metadata.name}`)
+		if err != nil {
+			return &errors.RetriableError{Err: err}
+		}
+		if strings.TrimSpace(stdout) == "" {
+			return &errors.RetriableError{Err: fmt.Errorf("no pending CSRs yet")}
+		}
+		for _, name := range strings.Fields(stdout) {
+			if _, stderr, err := ocConfig.RunOcCommand("adm", "certificate", "approve", name); err != nil {
+				return fmt.Errorf("Failed to approve CSR %s: %v: %s", name, err, stderr)
+			}
+		}
+		return nil
+	}
+	return errors.RetryAfter(60, approveCSRs, time.Second)
+}
+
+// forceOperatorRevision bumps the operator CR's forceRedeploymentReason,
+// which is what actually makes the operator roll a new revision of the
+// static pods (and thus their mounted certs) it renders for the node.
+func forceOperatorRevision(ocConfig oc.Config, operatorResource string) error {
+	cmdArgs := []string{"patch", operatorResource, "-p",
+		fmt.Sprintf(`'{"spec":{"forceRedeploymentReason":"cert rotation %s"}}'`, time.Now().Format(time.RFC3339)),
+		"--type", "merge"}
+	if _, stderr, err := ocConfig.RunOcCommand(cmdArgs...); err != nil {
+		return fmt.Errorf("Failed to force new revision of %s: %v: %s", operatorResource, err, stderr)
+	}
+	return nil
+}
+
+// rotateSignerSecret deletes the signer secret (causing its owning operator
+// to regenerate it) only when its certificate is already expired or invalid.
+// Deleting a still-valid signer rotates far more than the kubelet cert this
+// is meant to fix: it invalidates every cert it signs until they're all
+// re-minted, which is disruptive on its own and not warranted by a routine
+// kubelet-cert rotation.
+func rotateSignerSecret(ocConfig oc.Config, namespace, secret string) (bool, error) {
+	expired, err := signerSecretExpired(ocConfig, namespace, secret)
+	if err != nil {
+		return false, err
+	}
+	if !expired {
+		logging.Debugf("Signer %s/%s is still valid, leaving it in place", namespace, secret)
+		return false, nil
+	}
+	if _, stderr, err := ocConfig.RunOcCommand("delete", "secret", secret, "-n", namespace, "--ignore-not-found"); err != nil {
+		return false, fmt.Errorf("Failed to rotate signer secret %s/%s: %v: %s", namespace, secret, err, stderr)
+	}
+	return true, nil
+}
+
+// signerSecretExpired inspects the tls.crt in the given signer secret and
+// reports whether it has already expired. A missing secret or missing cert
+// data is treated as nothing to rotate.
+func signerSecretExpired(ocConfig oc.Config, namespace, secret string) (bool, error) {
+	stdout, stderr, err := ocConfig.RunOcCommand("get", "secret", secret, "-n", namespace, "--ignore-not-found", "-o", `jsonpath={.data.tls\.crt}`)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read signer secret %s/%s: %v: %s", namespace, secret, err, stderr)
+	}
+	stdout = strings.TrimSpace(stdout)
+	if stdout == "" {
+		return false, nil
+	}
+	pemBytes, err := base64.StdEncoding.DecodeString(stdout)
+	if err != nil {
+		return false, fmt.Errorf("Failed to decode signer secret %s/%s: %v", namespace, secret, err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return false, fmt.Errorf("Failed to decode PEM cert for signer secret %s/%s", namespace, secret)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse cert for signer secret %s/%s: %v", namespace, secret, err)
+	}
+	return time.Now().After(cert.NotAfter), nil
+}
@@ -139,11 +139,21 @@ func AddProxyConfigToCluster(ocConfig oc.Config, proxy *network.ProxyConfig) err
 // this is the job of machine config operator on the node and for crc this is not
 // possible so we do need to put it here.
 func AddProxyToKubeletAndCriO(sshRunner *ssh.Runner, proxy *network.ProxyConfig) error {
+	return writeProxyDropIns(sshRunner, proxy.HTTPProxy, proxy.HTTPSProxy, proxy.GetNoProxyString())
+}
+
+// writeProxyDropIns renders the kubelet/crio systemd drop-in for the given
+// proxy values and writes it to the instance. Both services need to be
+// restarted after this change. Since proxy operator is not able to make
+// changes to the kubelet/crio side, this is the job of machine config
+// operator on the node and for crc this is not possible so we do need to
+// put it here.
+func writeProxyDropIns(sshRunner *ssh.Runner, httpProxy, httpsProxy, noProxy string) error {
 	proxyTemplate := `[Service]
 Environment=HTTP_PROXY=%s
 Environment=HTTPS_PROXY=%s
 Environment=NO_PROXY=.cluster.local,.svc,10.128.0.0/14,172.30.0.0/16,%s`
-	p := fmt.Sprintf(proxyTemplate, proxy.HTTPProxy, proxy.HTTPSProxy, proxy.GetNoProxyString())
+	p := fmt.Sprintf(proxyTemplate, httpProxy, httpsProxy, noProxy)
 	// This will create a systemd drop-in configuration for proxy (both for kubelet and crio services) on the VM.
 	err := sshRunner.SetTextContentAsRoot("/etc/systemd/system/crio.service.d/10-default-env.conf", p, 0644)
 	if err != nil {
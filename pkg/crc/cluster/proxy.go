@@ -0,0 +1,162 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/code-ready/crc/pkg/crc/errors"
+	"github.com/code-ready/crc/pkg/crc/logging"
+	"github.com/code-ready/crc/pkg/crc/network"
+	"github.com/code-ready/crc/pkg/crc/oc"
+	"github.com/code-ready/crc/pkg/crc/ssh"
+)
+
+// ProxyOperatorDeployment identifies an operator deployment that is expected
+// to carry the cluster-wide proxy environment once it has been reconciled.
+type ProxyOperatorDeployment struct {
+	Name      string
+	Namespace string
+}
+
+// defaultProxyOperatorDeployments is the set of operators known to read
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY from their own deployment env rather than
+// picking it up from the Proxy CR directly.
+var defaultProxyOperatorDeployments = []ProxyOperatorDeployment{
+	{Name: "marketplace-operator", Namespace: "openshift-marketplace"},
+	{Name: "image-registry", Namespace: "openshift-image-registry"},
+	{Name: "router-default", Namespace: "openshift-ingress"},
+	{Name: "csi-snapshot-controller", Namespace: "openshift-cluster-storage-operator"},
+}
+
+// proxyStatus is the effective, operator-computed proxy as reported in
+// proxy/cluster's .status, as opposed to the user-provided .spec.
+type proxyStatus struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+}
+
+// ReconcileProxy patches the user-provided proxy spec onto the cluster, waits
+// for the Cluster Network Operator to compute and stabilize the effective
+// proxy in .status, renders the kubelet/crio drop-ins from that effective
+// proxy, and then walks the known operator deployments to make sure they
+// carry the proxy env. The deployments are checked and patched against the
+// user-provided proxy, not against the effective .status values.
+func ReconcileProxy(ocConfig oc.Config, sshRunner *ssh.Runner, proxy *network.ProxyConfig) error {
+	if err := AddProxyConfigToCluster(ocConfig, proxy); err != nil {
+		return err
+	}
+
+	status, err := waitForProxyStatus(ocConfig)
+	if err != nil {
+		return err
+	}
+	logging.Debugf("Effective proxy: httpProxy=%s httpsProxy=%s noProxy=%s", status.HTTPProxy, status.HTTPSProxy, status.NoProxy)
+
+	if err := writeProxyDropIns(sshRunner, status.HTTPProxy, status.HTTPSProxy, status.NoProxy); err != nil {
+		return err
+	}
+	// The drop-in is only picked up on the next start of each service.
+	if _, err := sshRunner.Run("sudo systemctl restart crio kubelet"); err != nil {
+		return fmt.Errorf("Failed to restart kubelet/crio after updating proxy drop-in: %v", err)
+	}
+
+	return WaitForProxyPropagated(ocConfig, proxy, defaultProxyOperatorDeployments)
+}
+
+// waitForProxyStatus polls proxy/cluster until at least one of
+// .status.httpProxy/.httpsProxy is populated and .status.httpProxy/.httpsProxy/.noProxy
+// have stopped changing between two consecutive reads.
+func waitForProxyStatus(ocConfig oc.Config) (*proxyStatus, error) {
+	var prev *proxyStatus
+	var stable *proxyStatus
+
+	checkProxyStatus := func() error {
+		current, err := getProxyStatus(ocConfig)
+		if err != nil {
+			return &errors.RetriableError{Err: err}
+		}
+		if current.HTTPProxy == "" && current.HTTPSProxy == "" {
+			return &errors.RetriableError{Err: fmt.Errorf("proxy status not yet populated")}
+		}
+		if prev != nil && *prev == *current {
+			stable = current
+			return nil
+		}
+		prev = current
+		return &errors.RetriableError{Err: fmt.Errorf("proxy status has not stabilized yet")}
+	}
+
+	if err := errors.RetryAfter(60, checkProxyStatus, 2*time.Second); err != nil {
+		return nil, err
+	}
+	return stable, nil
+}
+
+func getProxyStatus(ocConfig oc.Config) (*proxyStatus, error) {
+	cmdArgs := []string{"get", "proxy", "cluster", "-o", `jsonpath={.status.httpProxy}|{.status.httpsProxy}|{.status.noProxy}`}
+	stdout, stderr, err := ocConfig.RunOcCommand(cmdArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get proxy status %v: %s", err, stderr)
+	}
+	parts := strings.SplitN(stdout, "|", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return &proxyStatus{HTTPProxy: parts[0], HTTPSProxy: parts[1], NoProxy: parts[2]}, nil
+}
+
+// WaitForProxyPropagated blocks until every deployment in deployments carries
+// the proxy env and has finished rolling out pods with it, patching the env
+// in first if it is missing.
+func WaitForProxyPropagated(ocConfig oc.Config, proxy *network.ProxyConfig, deployments []ProxyOperatorDeployment) error {
+	if !proxy.IsEnabled() {
+		return nil
+	}
+	for _, d := range deployments {
+		ensurePropagated := func() error {
+			ok, err := CheckProxySettingsForOperator(ocConfig, proxy, d.Name, d.Namespace)
+			if err != nil {
+				return &errors.RetriableError{Err: err}
+			}
+			if ok {
+				return nil
+			}
+			if err := patchOperatorProxyEnv(ocConfig, proxy, d.Name, d.Namespace); err != nil {
+				return &errors.RetriableError{Err: err}
+			}
+			return &errors.RetriableError{Err: fmt.Errorf("waiting for %s/%s to roll out proxy env", d.Namespace, d.Name)}
+		}
+		if err := errors.RetryAfter(120, ensurePropagated, 2*time.Second); err != nil {
+			return err
+		}
+		if err := waitForDeploymentRollout(ocConfig, d.Name, d.Namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForDeploymentRollout blocks until deployment's pods have actually
+// rolled out with its current spec, so a caller that only checked the env
+// var on the spec isn't fooled by pods still running the previous revision.
+func waitForDeploymentRollout(ocConfig oc.Config, deployment, namespace string) error {
+	cmdArgs := []string{"rollout", "status", "deployment/" + deployment, "-n", namespace, "--timeout=120s"}
+	if _, stderr, err := ocConfig.RunOcCommand(cmdArgs...); err != nil {
+		return fmt.Errorf("Failed waiting for %s/%s to roll out: %v: %s", namespace, deployment, err, stderr)
+	}
+	return nil
+}
+
+func patchOperatorProxyEnv(ocConfig oc.Config, proxy *network.ProxyConfig, deployment, namespace string) error {
+	cmdArgs := []string{"set", "env", "deployment", deployment,
+		fmt.Sprintf("HTTP_PROXY=%s", proxy.HTTPProxy),
+		fmt.Sprintf("HTTPS_PROXY=%s", proxy.HTTPSProxy),
+		fmt.Sprintf("NO_PROXY=%s", proxy.GetNoProxyString()),
+		"-n", namespace}
+	if _, stderr, err := ocConfig.RunOcCommand(cmdArgs...); err != nil {
+		return fmt.Errorf("Failed to patch proxy env on %s/%s: %v: %s", namespace, deployment, err, stderr)
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/code-ready/crc/pkg/crc/logging"
+	"github.com/code-ready/crc/pkg/crc/network"
+	"github.com/code-ready/crc/pkg/crc/oc"
+	"github.com/code-ready/crc/pkg/crc/ssh"
+)
+
+// machineNetworkInterface is the VM's single network interface, used both to
+// detect the current machine network and to re-address it.
+const machineNetworkInterface = "eth0"
+
+// ReconfigSpec describes the desired state of a running VM/cluster. Any zero
+// field is left untouched by Reconfigure.
+type ReconfigSpec struct {
+	PullSecret         string
+	ClusterID          string
+	Proxy              *network.ProxyConfig
+	MachineNetworkCIDR string
+	BaseDomain         string
+	SSHAuthorizedKeys  []string
+}
+
+// ReconfigDiff reports what Reconfigure actually changed, so callers can show
+// the user what happened instead of a blind "done".
+type ReconfigDiff struct {
+	Changed   []string
+	Unchanged []string
+}
+
+// reconfigBackup snapshots the VM and cluster state Reconfigure can roll back
+// to if a later step in the pass fails.
+type reconfigBackup struct {
+	kubeletCrioDropIn string
+	pullSecret        string
+	clusterID         string
+	httpProxy         string
+	httpsProxy        string
+	noProxy           string
+}
+
+// Reconfigure re-parameterizes an already-running VM/cluster in a single
+// ordered pass: pull secret, cluster ID, proxy, machine network, base domain
+// and SSH authorized keys. Each step first checks whether the target is
+// already in the desired state, so the whole pass is safe to call repeatedly
+// with the same spec, and ReconfigDiff reports only what actually changed.
+//
+// Only the pull-secret, cluster-id and proxy steps are transactional: if a
+// later step fails, they are rolled back to what was snapshotted at the
+// start. Machine network, base domain and SSH authorized keys are applied
+// directly against the VM and are not part of that transaction (they are
+// ordered last precisely so a failure has the smallest possible blast
+// radius); a failure after one of them leaves it applied.
+func Reconfigure(sshRunner *ssh.Runner, ocConfig oc.Config, spec ReconfigSpec) (*ReconfigDiff, error) {
+	diff := &ReconfigDiff{}
+	backup, err := snapshotReconfigState(ocConfig, sshRunner)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to snapshot state before reconfiguring: %v", err)
+	}
+
+	var proxyApplied bool
+	rollback := func() {
+		if rerr := restoreReconfigState(ocConfig, sshRunner, backup, proxyApplied); rerr != nil {
+			logging.Debugf("Failed to roll back reconfigure: %v", rerr)
+		}
+	}
+
+	// apply only runs fn (and records the step as Changed) when
+	// shouldApply is true AND fn reports the target wasn't already in the
+	// desired state; otherwise the step is recorded as Unchanged.
+	apply := func(name string, shouldApply bool, fn func() (bool, error)) error {
+		if !shouldApply {
+			diff.Unchanged = append(diff.Unchanged, name)
+			return nil
+		}
+		changed, err := fn()
+		if err != nil {
+			rollback()
+			return fmt.Errorf("Failed to reconfigure %s: %v", name, err)
+		}
+		if changed {
+			diff.Changed = append(diff.Changed, name)
+		} else {
+			diff.Unchanged = append(diff.Unchanged, name)
+		}
+		return nil
+	}
+
+	if err := apply("pull-secret", spec.PullSecret != "", func() (bool, error) {
+		changed, err := pullSecretChanged(sshRunner, spec.PullSecret)
+		if err != nil || !changed {
+			return false, err
+		}
+		return true, AddPullSecret(sshRunner, ocConfig, spec.PullSecret)
+	}); err != nil {
+		return diff, err
+	}
+
+	if err := apply("cluster-id", spec.ClusterID != "", func() (bool, error) {
+		changed, err := clusterIDChanged(ocConfig, spec.ClusterID)
+		if err != nil || !changed {
+			return false, err
+		}
+		return true, patchClusterID(ocConfig, spec.ClusterID)
+	}); err != nil {
+		return diff, err
+	}
+
+	if err := apply("proxy", spec.Proxy != nil, func() (bool, error) {
+		changed, err := proxyChanged(ocConfig, spec.Proxy)
+		if err != nil || !changed {
+			return false, err
+		}
+		if err := ReconcileProxy(ocConfig, sshRunner, spec.Proxy); err != nil {
+			return false, err
+		}
+		proxyApplied = true
+		return true, nil
+	}); err != nil {
+		return diff, err
+	}
+
+	if err := apply("machine-network", spec.MachineNetworkCIDR != "", func() (bool, error) {
+		changed, err := machineNetworkChanged(sshRunner, spec.MachineNetworkCIDR)
+		if err != nil || !changed {
+			return false, err
+		}
+		return true, reconfigureMachineNetwork(sshRunner, spec.MachineNetworkCIDR)
+	}); err != nil {
+		return diff, err
+	}
+
+	if err := apply("base-domain", spec.BaseDomain != "", func() (bool, error) {
+		changed, err := baseDomainChanged(sshRunner, spec.BaseDomain)
+		if err != nil || !changed {
+			return false, err
+		}
+		if err := updateBaseDomain(sshRunner, spec.BaseDomain); err != nil {
+			return false, err
+		}
+		// hostnames embedded in the serving certs changed, so they need
+		// to be reissued against the new base domain regardless of
+		// whether they had already expired.
+		_, err = ForceRotateCerts(sshRunner, ocConfig)
+		return true, err
+	}); err != nil {
+		return diff, err
+	}
+
+	if err := apply("ssh-authorized-keys", len(spec.SSHAuthorizedKeys) > 0, func() (bool, error) {
+		missing, err := missingSSHAuthorizedKeys(sshRunner, spec.SSHAuthorizedKeys)
+		if err != nil || len(missing) == 0 {
+			return false, err
+		}
+		return true, addSSHAuthorizedKeys(sshRunner, missing)
+	}); err != nil {
+		return diff, err
+	}
+
+	return diff, nil
+}
+
+func snapshotReconfigState(ocConfig oc.Config, sshRunner *ssh.Runner) (*reconfigBackup, error) {
+	dropIn, err := sshRunner.Run("sudo cat /etc/systemd/system/kubelet.service.d/10-default-env.conf 2>/dev/null || true")
+	if err != nil {
+		return nil, err
+	}
+	pullSecret, err := sshRunner.Run("sudo cat /var/lib/kubelet/config.json 2>/dev/null || true")
+	if err != nil {
+		return nil, err
+	}
+	clusterID, stderr, err := ocConfig.RunOcCommand("get", "clusterversion", "version", "-o", "jsonpath={.spec.clusterID}")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to snapshot cluster ID %v: %s", err, stderr)
+	}
+	httpProxy, httpsProxy, noProxy, err := currentProxySpec(ocConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &reconfigBackup{
+		kubeletCrioDropIn: dropIn,
+		pullSecret:        pullSecret,
+		clusterID:         strings.TrimSpace(clusterID),
+		httpProxy:         httpProxy,
+		httpsProxy:        httpsProxy,
+		noProxy:           noProxy,
+	}, nil
+}
+
+func restoreReconfigState(ocConfig oc.Config, sshRunner *ssh.Runner, backup *reconfigBackup, proxyApplied bool) error {
+	if strings.TrimSpace(backup.kubeletCrioDropIn) != "" {
+		if err := sshRunner.SetTextContentAsRoot("/etc/systemd/system/kubelet.service.d/10-default-env.conf", backup.kubeletCrioDropIn, 0644); err != nil {
+			return err
+		}
+		if err := sshRunner.SetTextContentAsRoot("/etc/systemd/system/crio.service.d/10-default-env.conf", backup.kubeletCrioDropIn, 0644); err != nil {
+			return err
+		}
+	} else if proxyApplied {
+		// There was no drop-in before the proxy step wrote one.
+		if _, err := sshRunner.Run("sudo rm -f /etc/systemd/system/kubelet.service.d/10-default-env.conf /etc/systemd/system/crio.service.d/10-default-env.conf"); err != nil {
+			return err
+		}
+	}
+	if strings.TrimSpace(backup.pullSecret) != "" {
+		if err := AddPullSecret(sshRunner, ocConfig, backup.pullSecret); err != nil {
+			return err
+		}
+	}
+	if backup.clusterID != "" {
+		if err := patchClusterID(ocConfig, backup.clusterID); err != nil {
+			return err
+		}
+	}
+	// Restore whenever the proxy step actually ran, even if the
+	// pre-reconfigure cluster had no proxy at all (backup fields empty):
+	// keying off non-empty backup values would silently skip clearing a
+	// proxy that was applied from a no-proxy starting point.
+	if proxyApplied {
+		if err := patchProxySpec(ocConfig, backup.httpProxy, backup.httpsProxy, backup.noProxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pullSecretChanged(sshRunner *ssh.Runner, pullSec string) (bool, error) {
+	current, err := sshRunner.Run("sudo cat /var/lib/kubelet/config.json 2>/dev/null || true")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(current) != strings.TrimSpace(pullSec), nil
+}
+
+func clusterIDChanged(ocConfig oc.Config, clusterID string) (bool, error) {
+	current, stderr, err := ocConfig.RunOcCommand("get", "clusterversion", "version", "-o", "jsonpath={.spec.clusterID}")
+	if err != nil {
+		return false, fmt.Errorf("Failed to read current cluster ID %v: %s", err, stderr)
+	}
+	return strings.TrimSpace(current) != clusterID, nil
+}
+
+func currentProxySpec(ocConfig oc.Config) (httpProxy, httpsProxy, noProxy string, err error) {
+	stdout, stderr, err := ocConfig.RunOcCommand("get", "proxy", "cluster", "-o", `jsonpath={.spec.httpProxy}|{.spec.httpsProxy}|{.spec.noProxy}`)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Failed to read current proxy spec %v: %s", err, stderr)
+	}
+	parts := strings.SplitN(stdout, "|", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+func proxyChanged(ocConfig oc.Config, proxy *network.ProxyConfig) (bool, error) {
+	httpProxy, httpsProxy, noProxy, err := currentProxySpec(ocConfig)
+	if err != nil {
+		return false, err
+	}
+	return httpProxy != proxy.HTTPProxy || httpsProxy != proxy.HTTPSProxy || noProxy != proxy.GetNoProxyString(), nil
+}
+
+func patchProxySpec(ocConfig oc.Config, httpProxy, httpsProxy, noProxy string) error {
+	cmdArgs := []string{"patch", "proxy", "cluster", "-p",
+		fmt.Sprintf(`'{"spec":{"httpProxy":"%s", "httpsProxy":"%s", "noProxy":"%s"}}'`, httpProxy, httpsProxy, noProxy),
+		"-n", "openshift-config", "--type", "merge"}
+	if _, stderr, err := ocConfig.RunOcCommand(cmdArgs...); err != nil {
+		return fmt.Errorf("Failed to restore proxy spec %v: %s", err, stderr)
+	}
+	return nil
+}
+
+func machineNetworkChanged(sshRunner *ssh.Runner, cidr string) (bool, error) {
+	_, currentNet, err := currentMachineNetwork(sshRunner)
+	if err != nil {
+		return false, err
+	}
+	return currentNet.String() != cidr, nil
+}
+
+// currentMachineNetwork returns the VM's current address on
+// machineNetworkInterface and the network CIDR it sits on.
+func currentMachineNetwork(sshRunner *ssh.Runner) (net.IP, *net.IPNet, error) {
+	out, err := sshRunner.Run(fmt.Sprintf("ip -4 -o addr show dev %s | awk '{print $4}'", machineNetworkInterface))
+	if err != nil {
+		return nil, nil, err
+	}
+	ip, ipNet, err := net.ParseCIDR(strings.TrimSpace(out))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse current address on %s: %v", machineNetworkInterface, err)
+	}
+	return ip, ipNet, nil
+}
+
+func baseDomainChanged(sshRunner *ssh.Runner, baseDomain string) (bool, error) {
+	out, err := sshRunner.Run(fmt.Sprintf("grep -q 'apps.%s' /etc/hosts && echo present || true", baseDomain))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) != "present", nil
+}
+
+func patchClusterID(ocConfig oc.Config, clusterID string) error {
+	cmdArgs := []string{"patch", "clusterversion", "version", "-p",
+		fmt.Sprintf(`'{"spec":{"clusterID":"%s"}}'`, clusterID), "--type", "merge"}
+	if err := WaitForOpenshiftResource(ocConfig, "clusterversion"); err != nil {
+		return err
+	}
+	if _, stderr, err := ocConfig.RunOcCommand(cmdArgs...); err != nil {
+		return fmt.Errorf("Failed to update cluster ID %v: %s", err, stderr)
+	}
+	return nil
+}
+
+// reconfigureMachineNetwork re-addresses the VM's primary interface onto a
+// new machine network CIDR, keeping its current host part (the part of the
+// address not covered by the network mask) rather than assigning the bare
+// network address. This is host/VM plumbing, not a cluster object: the
+// machine network is fixed at install time in the cluster's own config and
+// is not something operators expose for runtime patching.
+func reconfigureMachineNetwork(sshRunner *ssh.Runner, cidr string) error {
+	currentIP, _, err := currentMachineNetwork(sshRunner)
+	if err != nil {
+		return err
+	}
+	_, newNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("Invalid machine network CIDR %s: %v", cidr, err)
+	}
+	newAddr := hostAddrOnNetwork(currentIP, newNet)
+
+	cmd := fmt.Sprintf("sudo ip addr flush dev %s && sudo ip addr add %s dev %s",
+		machineNetworkInterface, newAddr, machineNetworkInterface)
+	if _, err := sshRunner.Run(cmd); err != nil {
+		return fmt.Errorf("Failed to reconfigure machine network to %s: %v", cidr, err)
+	}
+	return nil
+}
+
+// hostAddrOnNetwork re-homes currentIP's host part onto newNet, returning a
+// CIDR string (e.g. "192.168.200.11/24") suitable for assigning to an
+// interface. Falls back to host part 1 when the current host part is the
+// network address itself (all-zero host bits).
+func hostAddrOnNetwork(currentIP net.IP, newNet *net.IPNet) string {
+	curIP := currentIP.To4()
+	netIP := newNet.IP.To4()
+	newIP := make(net.IP, net.IPv4len)
+	hostBitsZero := true
+	for i := range newIP {
+		host := curIP[i] &^ newNet.Mask[i]
+		if host != 0 {
+			hostBitsZero = false
+		}
+		newIP[i] = netIP[i] | host
+	}
+	if hostBitsZero {
+		newIP[3] |= 1
+	}
+	ones, _ := newNet.Mask.Size()
+	return fmt.Sprintf("%s/%d", newIP, ones)
+}
+
+func updateBaseDomain(sshRunner *ssh.Runner, baseDomain string) error {
+	hostsEntry := fmt.Sprintf("192.168.130.11 api.crc.testing oauth-openshift.apps.%s console-openshift-console.apps.%s", baseDomain, baseDomain)
+	cmd := fmt.Sprintf(`sudo sh -c 'grep -v "apps\." /etc/hosts > /tmp/hosts.new; echo "%s" >> /tmp/hosts.new; mv /tmp/hosts.new /etc/hosts'`, hostsEntry)
+	if _, err := sshRunner.Run(cmd); err != nil {
+		return fmt.Errorf("Failed to update /etc/hosts for new base domain: %v", err)
+	}
+	if _, err := sshRunner.Run("sudo systemctl restart dnsmasq"); err != nil {
+		return fmt.Errorf("Failed to restart dnsmasq after base domain change: %v", err)
+	}
+	return nil
+}
+
+// missingSSHAuthorizedKeys returns the subset of keys not already present in
+// the VM's authorized_keys file.
+func missingSSHAuthorizedKeys(sshRunner *ssh.Runner, keys []string) ([]string, error) {
+	var missing []string
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		out, err := sshRunner.Run(fmt.Sprintf("grep -qxF '%s' /home/core/.ssh/authorized_keys && echo present || true", key))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(out) != "present" {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// addSSHAuthorizedKeys appends keys to the VM's authorized_keys file. Callers
+// are expected to have already filtered out keys that are already present
+// (see missingSSHAuthorizedKeys) so repeated calls don't duplicate entries.
+func addSSHAuthorizedKeys(sshRunner *ssh.Runner, keys []string) error {
+	cmd := fmt.Sprintf("echo '%s' | sudo tee -a /home/core/.ssh/authorized_keys > /dev/null", strings.Join(keys, "\n"))
+	if _, err := sshRunner.Run(cmd); err != nil {
+		return fmt.Errorf("Failed to add SSH authorized keys: %v", err)
+	}
+	return nil
+}
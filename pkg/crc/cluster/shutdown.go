@@ -0,0 +1,137 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/code-ready/crc/pkg/crc/errors"
+	"github.com/code-ready/crc/pkg/crc/logging"
+	"github.com/code-ready/crc/pkg/crc/oc"
+	"github.com/code-ready/crc/pkg/crc/ssh"
+)
+
+// leaderElectionLocks are the configmaps/leases a single-node cluster's
+// control plane operators hold onto across a stop/start cycle. Deleting them
+// before shutdown means the operators don't wait out a stale lease TTL
+// before becoming leader again on the next boot, mirroring how the
+// cluster-version-operator releases its lease on SIGTERM.
+var leaderElectionLocks = []struct {
+	Namespace string
+	Name      string
+}{
+	{Namespace: "openshift-cluster-version", Name: "version"},
+	{Namespace: "kube-system", Name: "kube-controller-manager"},
+	{Namespace: "kube-system", Name: "kube-scheduler"},
+	{Namespace: "openshift-apiserver-operator", Name: "openshift-apiserver-operator-lock"},
+}
+
+// ShutdownStageTiming records how long a single stage of GracefulShutdown took.
+type ShutdownStageTiming struct {
+	Stage    string
+	Duration time.Duration
+}
+
+// ShutdownReport is the result of GracefulShutdown.
+type ShutdownReport struct {
+	Stages []ShutdownStageTiming
+}
+
+// GracefulShutdown drains the single node, releases the control plane's
+// leader-election locks, stops kubelet/crio and syncs the disk, so the
+// cluster comes back up without paying for stale lease TTLs. timeout bounds
+// the drain's grace period.
+func GracefulShutdown(sshRunner *ssh.Runner, ocConfig oc.Config, timeout time.Duration) (*ShutdownReport, error) {
+	report := &ShutdownReport{}
+
+	stage := func(name string, fn func() error) error {
+		start := time.Now()
+		err := fn()
+		report.Stages = append(report.Stages, ShutdownStageTiming{Stage: name, Duration: time.Since(start)})
+		if err != nil {
+			return fmt.Errorf("Failed during %s stage of graceful shutdown: %v", name, err)
+		}
+		return nil
+	}
+
+	if err := stage("drain", func() error { return drainNode(ocConfig, timeout) }); err != nil {
+		return report, err
+	}
+
+	if err := stage("release-leader-election-locks", func() error { return releaseLeaderElectionLocks(ocConfig) }); err != nil {
+		return report, err
+	}
+
+	if err := stage("stop-services", func() error { return stopKubeletAndCrio(sshRunner, timeout) }); err != nil {
+		return report, err
+	}
+
+	if err := stage("sync-disk", func() error {
+		_, err := sshRunner.Run("sync")
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+func drainNode(ocConfig oc.Config, timeout time.Duration) error {
+	node, stderr, err := ocConfig.RunOcCommand("get", "nodes", "-o", "jsonpath={.items[0].metadata.name}")
+	if err != nil {
+		return fmt.Errorf("Failed to look up node name %v: %s", err, stderr)
+	}
+	node = strings.TrimSpace(node)
+
+	if _, stderr, err := ocConfig.RunOcCommand("adm", "cordon", node); err != nil {
+		return fmt.Errorf("Failed to cordon %s %v: %s", node, err, stderr)
+	}
+
+	gracePeriod := int(timeout.Seconds())
+	cmdArgs := []string{"adm", "drain", node,
+		"--ignore-daemonsets", "--delete-emptydir-data", "--force",
+		fmt.Sprintf("--grace-period=%d", gracePeriod),
+		fmt.Sprintf("--timeout=%s", timeout)}
+	if _, stderr, err := ocConfig.RunOcCommand(cmdArgs...); err != nil {
+		return fmt.Errorf("Failed to drain %s %v: %s", node, err, stderr)
+	}
+	return nil
+}
+
+func releaseLeaderElectionLocks(ocConfig oc.Config) error {
+	for _, lock := range leaderElectionLocks {
+		for _, kind := range []string{"configmap", "lease"} {
+			_, stderr, err := ocConfig.RunOcCommand("delete", kind, lock.Name, "-n", lock.Namespace, "--ignore-not-found")
+			if err != nil {
+				return fmt.Errorf("Failed to release %s %s/%s %v: %s", kind, lock.Namespace, lock.Name, err, stderr)
+			}
+		}
+	}
+	return nil
+}
+
+func stopKubeletAndCrio(sshRunner *ssh.Runner, timeout time.Duration) error {
+	if _, err := sshRunner.Run("sudo systemctl stop --no-block kubelet crio"); err != nil {
+		return fmt.Errorf("Failed to request kubelet/crio stop: %v", err)
+	}
+
+	containersExited := func() error {
+		out, err := sshRunner.Run("sudo crictl ps -q")
+		if err != nil {
+			return &errors.RetriableError{Err: err}
+		}
+		if strings.TrimSpace(out) != "" {
+			return &errors.RetriableError{Err: fmt.Errorf("containers still running")}
+		}
+		return nil
+	}
+
+	attempts := int(timeout.Seconds())
+	if attempts < 1 {
+		attempts = 1
+	}
+	if err := errors.RetryAfter(attempts, containersExited, time.Second); err != nil {
+		logging.Debugf("Containers did not exit within %s, proceeding anyway: %v", timeout, err)
+	}
+	return nil
+}
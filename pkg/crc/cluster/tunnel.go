@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/code-ready/crc/pkg/crc/logging"
+	"github.com/code-ready/crc/pkg/crc/ssh"
+)
+
+const apiServerAddr = "api.crc.testing:6443"
+
+// StartAPITunnel opens an SSH connection to the VM and forwards a local
+// ephemeral port to the in-VM API server, for hosts where the CRC network
+// integration can't reach api.crc.testing directly (captive portals,
+// restrictive corporate networks, WSL2 without vmnetd). Callers pass the
+// returned localAddr to oc.Config (TunnelLocalAddr, with UseSSHTunnel set)
+// and must call stop() once the tunnel is no longer needed.
+func StartAPITunnel(sshRunner *ssh.Runner) (localAddr string, stop func(), err error) {
+	client, err := sshRunner.Dial()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open SSH connection for API tunnel: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		client.Close()
+		return "", nil, fmt.Errorf("failed to listen on local ephemeral port: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-done:
+					return
+				default:
+					logging.Debugf("API tunnel listener closed: %v", err)
+					return
+				}
+			}
+			remote, err := client.Dial("tcp", apiServerAddr)
+			if err != nil {
+				logging.Debugf("API tunnel failed to reach %s over SSH: %v", apiServerAddr, err)
+				conn.Close()
+				continue
+			}
+			go proxyConn(conn, remote)
+		}
+	}()
+
+	stop = func() {
+		close(done)
+		listener.Close()
+		client.Close()
+	}
+	return listener.Addr().String(), stop, nil
+}
+
+func proxyConn(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	errc := make(chan error, 2)
+	copyFn := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		errc <- err
+	}
+	go copyFn(a, b)
+	go copyFn(b, a)
+	<-errc
+}
@@ -0,0 +1,59 @@
+package oc
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Config carries everything needed to invoke the oc binary against a CRC
+// cluster: where the binary lives, which kubeconfig to use, and, once
+// UseSSHTunnel is set, how to reach the API server when it is not directly
+// routable from the host.
+type Config struct {
+	OcExecutablePath    string
+	KubeconfigPath      string
+	AdminKubeconfigPath string
+	Context             string
+	Cluster             string
+
+	// UseSSHTunnel makes RunOcCommand/RunOcCommandPrivate rewrite the
+	// kubeconfig server to go through a local port forwarded over SSH to
+	// the VM instead of talking to api.crc.testing directly. This is set
+	// by callers that have already called StartAPITunnel.
+	UseSSHTunnel    bool
+	TunnelLocalAddr string
+}
+
+// RunOcCommand runs oc with the public kubeconfig (cluster-admin dropped).
+func (c Config) RunOcCommand(args ...string) (string, string, error) {
+	return c.runOcCommand(c.KubeconfigPath, args...)
+}
+
+// RunOcCommandPrivate runs oc with the kubeconfig that still has
+// cluster-admin credentials, for operations regular users can't perform.
+func (c Config) RunOcCommandPrivate(args ...string) (string, string, error) {
+	return c.runOcCommand(c.AdminKubeconfigPath, args...)
+}
+
+func (c Config) runOcCommand(kubeconfigPath string, args ...string) (string, string, error) {
+	if c.UseSSHTunnel {
+		tunneled, err := tunnelKubeconfig(kubeconfigPath, c.TunnelLocalAddr)
+		if err != nil {
+			return "", "", err
+		}
+		defer os.Remove(tunneled)
+		kubeconfigPath = tunneled
+	}
+
+	cmdArgs := append([]string{"--kubeconfig", kubeconfigPath, "--context", c.Context}, args...)
+	cmd := exec.Command(c.OcExecutablePath, cmdArgs...) // #nosec G204
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), stderr.String(), fmt.Errorf("failed to run oc %s: %v", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(stdout.String()), strings.TrimSpace(stderr.String()), nil
+}
@@ -0,0 +1,31 @@
+package oc
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// tunnelKubeconfig rewrites a copy of the kubeconfig at kubeconfigPath so
+// every cluster in it points at localAddr (a 127.0.0.1:<port> forwarded
+// over SSH to the VM's API server) instead of api.crc.testing, keeping TLS
+// verification working by pinning the original server name.
+func tunnelKubeconfig(kubeconfigPath, localAddr string) (string, error) {
+	config, err := clientcmd.LoadFromFile(kubeconfigPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load kubeconfig for tunneling: %v", err)
+	}
+	for _, cluster := range config.Clusters {
+		cluster.Server = fmt.Sprintf("https://%s", localAddr)
+		cluster.TLSServerName = "api.crc.testing"
+	}
+	tmpfile, err := ioutil.TempFile("", "crc-tunnel-kubeconfig-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create tunnel kubeconfig: %v", err)
+	}
+	if err := clientcmd.WriteToFile(*config, tmpfile.Name()); err != nil {
+		return "", fmt.Errorf("failed to write tunnel kubeconfig: %v", err)
+	}
+	return tmpfile.Name(), nil
+}
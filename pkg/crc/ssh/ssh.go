@@ -0,0 +1,90 @@
+package ssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Runner executes commands and writes files on a CRC VM over SSH.
+type Runner struct {
+	IP             string
+	Port           int
+	PrivateKeyPath string
+	User           string
+}
+
+// NewRunner creates a Runner targeting the given VM.
+func NewRunner(ip string, port int, privateKeyPath, user string) *Runner {
+	return &Runner{IP: ip, Port: port, PrivateKeyPath: privateKeyPath, User: user}
+}
+
+// Run executes cmd on the VM and returns its combined stdout and stderr.
+func (r *Runner) Run(cmd string) (string, error) {
+	client, err := r.dial()
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create SSH session: %v", err)
+	}
+	defer session.Close()
+
+	out, err := session.CombinedOutput(cmd)
+	if err != nil {
+		return string(out), fmt.Errorf("failed to run %q over SSH: %v", cmd, err)
+	}
+	return string(out), nil
+}
+
+// SetTextContentAsRoot writes content to destFilename on the VM as root,
+// creating/overwriting it with the given permissions.
+func (r *Runner) SetTextContentAsRoot(destFilename, content string, mode os.FileMode) error {
+	cmd := fmt.Sprintf("sudo install -m %o /dev/stdin %s", mode, destFilename)
+	client, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create SSH session: %v", err)
+	}
+	defer session.Close()
+
+	session.Stdin = strings.NewReader(content)
+	if out, err := session.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("failed to write %s over SSH: %v: %s", destFilename, err, out)
+	}
+	return nil
+}
+
+// Dial opens a new SSH client connection to the VM. Callers that need raw
+// channels (e.g. for port forwarding) use this instead of Run.
+func (r *Runner) Dial() (*ssh.Client, error) {
+	return r.dial()
+}
+
+func (r *Runner) dial() (*ssh.Client, error) {
+	key, err := ioutil.ReadFile(r.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH private key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH private key: %v", err)
+	}
+	config := &ssh.ClientConfig{
+		User:            r.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // #nosec G106 -- CRC VM host key is not pinned today
+	}
+	return ssh.Dial("tcp", fmt.Sprintf("%s:%d", r.IP, r.Port), config)
+}